@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+ * Package fuse exposes a mounted govfs.Header as a real POSIX filesystem via
+ * github.com/hanwen/go-fuse/v2, in the style of gocryptfs's fusefrontend: it
+ * translates FUSE ops into calls against the plain govfs.Header API, so a
+ * .gofs container can be `mount`ed and used with ordinary file tools.
+ */
+package fuse
+
+import (
+    "context"
+    "sync"
+    "syscall"
+    "time"
+
+    fusefs "github.com/hanwen/go-fuse/v2/fs"
+    "github.com/hanwen/go-fuse/v2/fuse"
+
+    govfs "github.com/wade-welles/govfs"
+)
+
+/* node is a single FUSE inode backed by a path inside a govfs.Header. path
+ * never has a trailing slash (the root node's path is ""); is_dir is
+ * resolved once, at Lookup/Create/Mkdir time, since govfs itself encodes
+ * directory-ness via a trailing slash on the stored name. */
+type node struct {
+    fusefs.Inode
+
+    fsys   *govfs.Header
+    path   string
+    is_dir bool
+}
+
+/* fs_path is the name used to address this node inside the govfs.Header. */
+func (n *node) fs_path() string {
+    if n.path == "" {
+        return "/"
+    }
+    if n.is_dir {
+        return n.path + "/"
+    }
+    return n.path
+}
+
+func child_path(parent string, name string) string {
+    if parent == "" {
+        return "/" + name
+    }
+    return parent + "/" + name
+}
+
+/* Root returns the root InodeEmbedder for fusefs.Mount. */
+func Root(fsys *govfs.Header) fusefs.InodeEmbedder {
+    return &node{fsys: fsys, path: "", is_dir: true}
+}
+
+/* Unmount flushes the in-memory filesystem back to its encrypted container,
+ * passing flags through to govfs.Header.Unmount unchanged; the container
+ * can then be mounted again only with those same flags. Callers should call
+ * server.Unmount() (from fusefs.Mount's return value) before this, so no
+ * FUSE op races the flush. */
+func Unmount(fsys *govfs.Header, flags int) int {
+    return fsys.Unmount(nil, flags)
+}
+
+var _ = (fusefs.NodeLookuper)((*node)(nil))
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+    path := child_path(n.path, name)
+
+    st, status := n.fsys.Stat(path)
+    is_dir := false
+    if status != govfs.STATUS_OK {
+        st, status = n.fsys.Stat(path + "/")
+        is_dir = true
+    }
+    if status != govfs.STATUS_OK {
+        return nil, syscall.ENOENT
+    }
+
+    fill_attr(&out.Attr, st, is_dir)
+
+    child := &node{fsys: n.fsys, path: path, is_dir: is_dir}
+    mode := uint32(syscall.S_IFREG)
+    if is_dir {
+        mode = syscall.S_IFDIR
+    }
+    return n.NewInode(ctx, child, fusefs.StableAttr{Mode: mode}), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*node)(nil))
+
+func (n *node) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+    st, status := n.fsys.Stat(n.fs_path())
+    if status != govfs.STATUS_OK {
+        return syscall.ENOENT
+    }
+
+    fill_attr(&out.Attr, st, n.is_dir)
+    return 0
+}
+
+var _ = (fusefs.NodeSetattrer)((*node)(nil))
+
+func (n *node) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+    if sz, ok := in.GetSize(); ok {
+        if status := n.fsys.Truncate(n.fs_path(), uint(sz)); status != govfs.STATUS_OK {
+            return syscall.EIO
+        }
+    }
+
+    st, status := n.fsys.Stat(n.fs_path())
+    if status != govfs.STATUS_OK {
+        return syscall.ENOENT
+    }
+    fill_attr(&out.Attr, st, n.is_dir)
+    return 0
+}
+
+var _ = (fusefs.NodeReaddirer)((*node)(nil))
+
+func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+    entries, status := n.fsys.ReadDir(n.fs_path())
+    if status != govfs.STATUS_OK {
+        return nil, syscall.ENOENT
+    }
+
+    list := make([]fuse.DirEntry, 0, len(entries))
+    for _, e := range entries {
+        mode := uint32(syscall.S_IFREG)
+        if e.IsDir {
+            mode = syscall.S_IFDIR
+        }
+        list = append(list, fuse.DirEntry{Name: e.Name, Mode: mode})
+    }
+
+    return fusefs.NewListDirStream(list), 0
+}
+
+var _ = (fusefs.NodeOpener)((*node)(nil))
+
+func (n *node) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+    return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+var _ = (fusefs.NodeReader)((*node)(nil))
+
+func (n *node) Read(ctx context.Context, fh fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+    count, status := n.fsys.ReadAt(n.fs_path(), off, dest)
+    if status != govfs.STATUS_OK {
+        return nil, syscall.EIO
+    }
+
+    return fuse.ReadResultData(dest[:count]), 0
+}
+
+var _ = (fusefs.NodeWriter)((*node)(nil))
+
+func (n *node) Write(ctx context.Context, fh fusefs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+    written, status := n.fsys.WriteAt(n.fs_path(), off, data)
+    if status != govfs.STATUS_OK {
+        return 0, syscall.EIO
+    }
+
+    return uint32(written), 0
+}
+
+var _ = (fusefs.NodeCreater)((*node)(nil))
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+    path := child_path(n.path, name)
+
+    if status := n.fsys.Create(path); status != govfs.STATUS_OK {
+        return nil, nil, 0, syscall.EIO
+    }
+
+    st, _ := n.fsys.Stat(path)
+    fill_attr(&out.Attr, st, false)
+
+    child := &node{fsys: n.fsys, path: path, is_dir: false}
+    return n.NewInode(ctx, child, fusefs.StableAttr{Mode: syscall.S_IFREG}), nil, 0, 0
+}
+
+var _ = (fusefs.NodeMkdirer)((*node)(nil))
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+    path := child_path(n.path, name)
+
+    if status := n.fsys.Mkdir(path); status != govfs.STATUS_OK {
+        return nil, syscall.EIO
+    }
+
+    st, _ := n.fsys.Stat(path + "/")
+    fill_attr(&out.Attr, st, true)
+
+    child := &node{fsys: n.fsys, path: path, is_dir: true}
+    return n.NewInode(ctx, child, fusefs.StableAttr{Mode: syscall.S_IFDIR}), 0
+}
+
+var _ = (fusefs.NodeUnlinker)((*node)(nil))
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+    path := child_path(n.path, name)
+    if status := n.fsys.Delete(path); status != govfs.STATUS_OK {
+        return syscall.EIO
+    }
+    return 0
+}
+
+var _ = (fusefs.NodeRmdirer)((*node)(nil))
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+    path := child_path(n.path, name) + "/"
+    if status := n.fsys.Delete(path); status != govfs.STATUS_OK {
+        return syscall.EIO
+    }
+    return 0
+}
+
+var _ = (fusefs.NodeRenamer)((*node)(nil))
+
+func (n *node) Rename(ctx context.Context, name string, new_parent fusefs.InodeEmbedder, new_name string, flags uint32) syscall.Errno {
+    old_path := child_path(n.path, name)
+
+    new_parent_node, ok := new_parent.(*node)
+    if !ok {
+        return syscall.EINVAL
+    }
+    new_path := child_path(new_parent_node.path, new_name)
+
+    if status := n.fsys.Rename(old_path, new_path); status != govfs.STATUS_OK {
+        return syscall.EIO
+    }
+    return 0
+}
+
+func fill_attr(out *fuse.Attr, st govfs.Stat, is_dir bool) {
+    out.Mode = st.Mode
+    if is_dir {
+        out.Mode |= syscall.S_IFDIR
+    } else {
+        out.Mode |= syscall.S_IFREG
+    }
+    out.Size = uint64(st.Size)
+    out.Mtime = uint64(st.Mtime)
+    out.Ctime = uint64(st.Mtime)
+    out.Atime = uint64(st.Mtime)
+}
+
+/* mount_lock serializes calls to Mount. It is held only while fusefs.Mount
+ * runs; Unmount and the FUSE ops served afterwards do not take it. */
+var mount_lock sync.Mutex
+
+/* Mount attaches fsys at dir and serves FUSE requests until the returned
+ * server is unmounted. This is a thin convenience wrapper around
+ * fusefs.Mount + Root. */
+func Mount(dir string, fsys *govfs.Header, options *fusefs.Options) (*fuse.Server, error) {
+    mount_lock.Lock()
+    defer mount_lock.Unlock()
+
+    if options == nil {
+        timeout := time.Second
+        options = &fusefs.Options{
+            EntryTimeout: &timeout,
+            AttrTimeout:  &timeout,
+        }
+    }
+
+    return fusefs.Mount(dir, Root(fsys), options)
+}
@@ -44,10 +44,9 @@ import (
     "bytes"
     "sync"
     "strings"
-    "crypto/aes"
-    "crypto/cipher"
     "crypto/rand"
     "io"
+    "time"
 )
 
 /*
@@ -64,16 +63,28 @@ const STATUS_NOT_READABLE       int = -4
 const STATUS_NAME_EXCEEDED      int = -5 /* Input name is too long for create() */
 const STATUS_FS_WRITE           int = -6 /* Failure in serializing and writing the filesystem */
 const STATUS_FS_ENC_COMP        int = -7 /* Compression/encryption failure FIXME -- separate these two */
+const STATUS_FEC_UNRECOVERABLE  int = -8 /* Too many corrupted shares to reconstruct a block */
+const STATUS_AUTH_FAIL          int = -9 /* Container header or AEAD tag did not authenticate */
+const STATUS_ARCHIVE_ERROR      int = -10 /* Failure reading or writing a zip/tar archive */
 
 const IRP_PURGE                 int = 2 /* Flush the entire database and all files */
 const IRP_DELETE                int = 3 /* Delete a file/folder */
 const IRP_WRITE                 int = 4 /* Write data to a file */
 const IRP_CREATE                int = 5 /* Create a new file or folder */
+const IRP_RENAME                int = 6 /* Rename/move a file or folder */
+const IRP_TRUNCATE              int = 7 /* Resize a file to an explicit length */
+const IRP_WRITE_AT               int = 8 /* Write data to a file at a byte offset */
 
 const FLAG_FILE                 int = 1
 const FLAG_DIRECTORY            int = 2
-const FLAG_COMPRESS             int = 4 /* Compression on the fs serialized output */
-const FLAG_ENCRYPT              int = 8 /* Encryption on the fs serialized output */
+const FLAG_COMPRESS             int = 4  /* Compression on the fs serialized output */
+const FLAG_ENCRYPT              int = 8  /* Encryption on the fs serialized output */
+const FLAG_FEC                  int = 16 /* Wrap the ciphertext in Reed-Solomon shares so bit rot is recoverable */
+const FLAG_FEC_FAST             int = 32 /* Skip share verification on load and trust the fast-path 128 bytes */
+const FLAG_ENCRYPT_NAMES        int = 64 /* Store EME-encrypted path segments instead of plaintext names on disk */
+
+const DEFAULT_FILE_MODE         uint32 = 0644
+const DEFAULT_DIR_MODE          uint32 = 0755
 
 type gofs_header struct {
     filename    string
@@ -82,6 +93,12 @@ type gofs_header struct {
     t_size      uint /* Total size of all files */
     io_in       chan *gofs_io_block
     create_sync sync.Mutex
+
+    passphrase  string    /* Used to re-derive the master key on every unmount_db */
+    salt        [16]byte  /* Random per-container Argon2id salt, stored in the header */
+    kdf         KDFParams
+    root_dir_iv [16]byte  /* EME tweak for top-level entries when FLAG_ENCRYPT_NAMES is used */
+    chunk_size  uint      /* Files are gzipped/sealed in chunk_size pieces on unmount_db; see govfs_chunks.go */
 }
 
 type gofs_file struct {
@@ -90,104 +107,170 @@ type gofs_file struct {
     datasum     string
     data        []byte
     lock        sync.Mutex
+    mode        uint32 /* POSIX permission bits, e.g. 0644/0755 */
+    mtime       int64  /* Unix seconds of last modification */
+    dir_iv      [16]byte /* Random per-directory EME tweak for this entry's children; unused on files */
+    file_id     [16]byte /* Identifies this file's chunks to chunk_nonce; unused on directories */
 }
 
 type gofs_io_block struct {
     file        *gofs_file
     name        string
+    dest        string /* Destination path for IRP_RENAME */
     data        []byte
+    off         int64  /* Byte offset for IRP_WRITE_AT, target size for IRP_TRUNCATE */
     status      int /* 0 == fail, 1 == ok, 2 == purge, 3 == delete, 4 == write */
     flags       int
     io_out      chan *gofs_io_block
 }
 
-func create_db(filename string) *gofs_header {
+/* create_db starts a new in-memory filesystem backed by an encrypted
+ * container at filename. The passphrase is run through Argon2id (params)
+ * plus a fresh random salt to derive the master key on every unmount_db --
+ * it is kept only in memory and never written to disk. */
+func create_db(filename string, passphrase string, params KDFParams) *gofs_header {
     var header                      = new(gofs_header)
     header.filename                 = filename
     header.meta                     = make(map[string]*gofs_file)
     header.meta[s("/")]             = new(gofs_file)
     header.meta[s("/")].filename    = "/"
+    header.passphrase               = passphrase
+    header.kdf                      = params
+    if _, err := io.ReadFull(rand.Reader, header.salt[:]); err != nil {
+        out("ERROR: failed to generate KDF salt")
+    }
+    header.root_dir_iv = random_dir_iv()
+    header.chunk_size = DEFAULT_CHUNK_SIZE
 
     /* i/o channel processor. Performs i/o to the filesystem */
     header.io_in = make(chan *gofs_io_block)
     go func (f *gofs_header) {
         for {
             var io = <- header.io_in
-            
-            switch io.status {
-            case IRP_PURGE:
-                /* PURGE */
-                out("ERROR: PURGING")
-                close(header.io_in)
+            if !f.process_irp(io) {
                 return
-            case IRP_DELETE:
-                /* DELETE */
-                // FIXME/ADDME
-                io.status = STATUS_ERROR
-                if io.file.filename == "/" { /* Cannot delete the root file */
-                    io.status = STATUS_ERROR
-                    io.io_out <- io
-                } else {
-                    if i := f.check(io.name); i != nil {
-                        delete(f.meta, s(io.name))
-                        f.meta[s(io.name)] = nil
-                        io.status = STATUS_OK
-                    }
-                    io.io_out <- io
-                }
-            case IRP_WRITE:
-                /* WRITE */
-                if i := f.check(io.name); i != nil {
-                    io.file.lock.Lock()
-                    if f.write_internal(i, io.data) == len(io.data) {
-                        io.status = STATUS_OK
-                        io.file.lock.Unlock()
-                        io.io_out <- io
-                    } else {
-                        io.status = STATUS_ERROR
-                        io.file.lock.Unlock()
-                        io.io_out <- io
-                    }
-                }
-            case IRP_CREATE:          
-                f.meta[s(io.name)] = new(gofs_file)
-                io.file = f.meta[s(io.name)]                
-                io.file.filename = io.name
-                
-                if string(io.name[len(io.name) - 1:]) == "/" {
-                    io.file.filetype = FLAG_DIRECTORY
-                } else {
-                    io.file.filetype = FLAG_FILE
-                }
-                
-                /* Recursively create all subdirectory files */
-                sub_strings := strings.Split(io.name, "/")
-                sub_array := make([]string, len(sub_strings) - 2)
-                copy(sub_array, sub_strings[1:len(sub_strings) - 1]) /* We do not need the first/last file */
-                var tmp string = ""
-                for e := range sub_array {
-                    tmp += "/" + sub_array[e]
-
-                    /* Create a subdirectory header */
-                    func (sub_directory string, f *gofs_header) {
-                        if f := f.check(sub_directory); f != nil {
-                            return /* There can exist two files with the same name,
-                                       as long as one is a directory and the other is a file */
-                        }
-
-                        f.meta[s(tmp)] = new(gofs_file)
-                        f.meta[s(tmp)].filename = sub_directory + "/" /* Explicit directory name */
-                        f.meta[s(tmp)].filetype = FLAG_DIRECTORY
-                    } (tmp, f)
-                }
+            }
+        }
+    } (header)
 
+    return header
+}
+
+/*
+ * process_irp services a single IRP on the i/o channel goroutine; it is
+ * shared by the create_db and mount_db processors. Returns false when the
+ * goroutine should terminate (IRP_PURGE).
+ */
+func (f *gofs_header) process_irp(io *gofs_io_block) bool {
+    switch io.status {
+    case IRP_PURGE:
+        /* PURGE */
+        out("ERROR: PURGING")
+        close(f.io_in)
+        return false
+    case IRP_DELETE:
+        /* DELETE */
+        // FIXME/ADDME
+        io.status = STATUS_ERROR
+        if io.file.filename == "/" { /* Cannot delete the root file */
+            io.status = STATUS_ERROR
+            io.io_out <- io
+        } else {
+            if i := f.check(io.name); i != nil {
+                delete(f.meta, s(io.name))
                 io.status = STATUS_OK
+            }
+            io.io_out <- io
+        }
+    case IRP_WRITE:
+        /* WRITE */
+        if i := f.check(io.name); i != nil {
+            io.file.lock.Lock()
+            if f.write_internal(i, io.data) == len(io.data) {
+                io.status = STATUS_OK
+                io.file.lock.Unlock()
+                io.io_out <- io
+            } else {
+                io.status = STATUS_ERROR
+                io.file.lock.Unlock()
                 io.io_out <- io
             }
         }
-    } (header)
+    case IRP_WRITE_AT:
+        /* WRITE_AT -- write io.data into io.file at byte offset io.off */
+        if i := f.check(io.name); i != nil {
+            io.file.lock.Lock()
+            f.write_at_internal(i, io.off, io.data)
+            io.status = STATUS_OK
+            io.file.lock.Unlock()
+            io.io_out <- io
+        } else {
+            io.status = STATUS_NOT_FOUND
+            io.io_out <- io
+        }
+    case IRP_TRUNCATE:
+        /* TRUNCATE -- resize io.file to io.off bytes, zero-padding growth */
+        if i := f.check(io.name); i != nil {
+            io.file.lock.Lock()
+            f.truncate_internal(i, uint(io.off))
+            io.status = STATUS_OK
+            io.file.lock.Unlock()
+            io.io_out <- io
+        } else {
+            io.status = STATUS_NOT_FOUND
+            io.io_out <- io
+        }
+    case IRP_RENAME:
+        /* RENAME -- move io.name (and, if a directory, all of its children) to io.dest */
+        io.status = f.rename_internal(io.name, io.dest)
+        io.io_out <- io
+    case IRP_CREATE:
+        f.meta[s(io.name)] = new(gofs_file)
+        io.file = f.meta[s(io.name)]
+        io.file.filename = io.name
+
+        if string(io.name[len(io.name) - 1:]) == "/" {
+            io.file.filetype = FLAG_DIRECTORY
+            io.file.mode = DEFAULT_DIR_MODE
+            io.file.dir_iv = random_dir_iv()
+        } else {
+            io.file.filetype = FLAG_FILE
+            io.file.mode = DEFAULT_FILE_MODE
+            io.file.file_id = random_file_id()
+        }
+        io.file.mtime = time.Now().Unix()
+
+        /* Recursively create all subdirectory files */
+        sub_strings := strings.Split(io.name, "/")
+        sub_array := make([]string, len(sub_strings) - 2)
+        copy(sub_array, sub_strings[1:len(sub_strings) - 1]) /* We do not need the first/last file */
+        var tmp string = ""
+        for e := range sub_array {
+            tmp += "/" + sub_array[e]
+
+            /* Create a subdirectory header */
+            func (sub_directory string, f *gofs_header) {
+                if f := f.check(sub_directory + "/"); f != nil {
+                    return /* Already exists, either created explicitly or by an
+                               earlier sibling's auto-vivification of this same
+                               ancestor -- keep its dir_iv rather than handing
+                               out a second, divergent entry for it */
+                }
 
-    return header
+                f.meta[s(tmp + "/")] = new(gofs_file)
+                f.meta[s(tmp + "/")].filename = sub_directory + "/" /* Explicit directory name */
+                f.meta[s(tmp + "/")].filetype = FLAG_DIRECTORY
+                f.meta[s(tmp + "/")].mode = DEFAULT_DIR_MODE
+                f.meta[s(tmp + "/")].mtime = time.Now().Unix()
+                f.meta[s(tmp + "/")].dir_iv = random_dir_iv()
+            } (tmp, f)
+        }
+
+        io.status = STATUS_OK
+        io.io_out <- io
+    }
+
+    return true
 }
 
 func (f *gofs_header) check(name string) *gofs_file {
@@ -284,6 +367,126 @@ func (f *gofs_header) read(name string) ([]byte, int) {
     return output, STATUS_OK
 }
 
+/* read_at reads up to len(p) bytes starting at byte offset off, POSIX
+ * pread(2) style, without materializing the whole file. */
+func (f *gofs_header) read_at(name string, off int64, p []byte) (int, int) {
+    file_header := f.check(name)
+    if file_header == nil {
+        return 0, STATUS_NOT_FOUND
+    }
+
+    if file_header.filetype == FLAG_DIRECTORY {
+        return 0, STATUS_NOT_READABLE
+    }
+
+    file_header.lock.Lock()
+    defer file_header.lock.Unlock()
+
+    if off >= int64(len(file_header.data)) {
+        return 0, STATUS_OK
+    }
+
+    n := copy(p, file_header.data[off:])
+    return n, STATUS_OK
+}
+
+/* write_at writes d into name at byte offset off, POSIX pwrite(2) style,
+ * growing the file with zero bytes if off+len(d) extends past the current
+ * end of file. */
+func (f *gofs_header) write_at(name string, off int64, d []byte) (int, int) {
+    if f.check(name) == nil {
+        return 0, STATUS_NOT_FOUND
+    }
+
+    irp := new(gofs_io_block)
+    irp.name = name
+    irp.file = f.check(name)
+    irp.off = off
+    irp.data = make([]byte, len(d))
+    copy(irp.data, d)
+    irp.status = IRP_WRITE_AT
+    irp.io_out = make(chan *gofs_io_block)
+
+    f.io_in <- irp
+    output_irp := <- irp.io_out
+    close(irp.io_out)
+
+    if output_irp.status != STATUS_OK {
+        return 0, output_irp.status
+    }
+
+    return len(d), STATUS_OK
+}
+
+/* truncate resizes name to exactly size bytes, zero-padding growth and
+ * discarding anything past size when shrinking. */
+func (f *gofs_header) truncate(name string, size uint) int {
+    if f.check(name) == nil {
+        return STATUS_NOT_FOUND
+    }
+
+    irp := new(gofs_io_block)
+    irp.name = name
+    irp.file = f.check(name)
+    irp.off = int64(size)
+    irp.status = IRP_TRUNCATE
+    irp.io_out = make(chan *gofs_io_block)
+
+    f.io_in <- irp
+    output_irp := <- irp.io_out
+    close(irp.io_out)
+
+    return output_irp.status
+}
+
+/* rename moves old_name to new_name. If old_name is a directory, all of its
+ * descendants are moved along with it (their keys are re-hashed under the
+ * new prefix since f.meta is keyed by md5(fullpath), not by tree edges).
+ * Directories are keyed with a trailing slash (the same convention mkdir
+ * uses), so callers may pass either "/d" or "/d/" for a directory -- if
+ * old_name doesn't match as given but does with a trailing slash added,
+ * both names are normalized to the directory form before proceeding. */
+func (f *gofs_header) rename(old_name string, new_name string) int {
+    if f.check(old_name) == nil && !strings.HasSuffix(old_name, "/") && f.check(old_name+"/") != nil {
+        old_name += "/"
+        if !strings.HasSuffix(new_name, "/") {
+            new_name += "/"
+        }
+    }
+
+    if f.check(old_name) == nil {
+        return STATUS_NOT_FOUND
+    }
+
+    if f.check(new_name) != nil {
+        return STATUS_EXISTS
+    }
+
+    irp := new(gofs_io_block)
+    irp.name = old_name
+    irp.dest = new_name
+    irp.status = IRP_RENAME
+    irp.io_out = make(chan *gofs_io_block)
+
+    f.io_in <- irp
+    output_irp := <- irp.io_out
+    close(irp.io_out)
+
+    return output_irp.status
+}
+
+/* mkdir is an explicit directory-create IRP: unlike create(), it does not
+ * imply anything about the type of name beyond "this is a directory", and
+ * it fails with STATUS_EXISTS instead of silently succeeding if name is
+ * already present. */
+func (f *gofs_header) mkdir(name string) (*gofs_file, int) {
+    if string(name[len(name) - 1:]) != "/" {
+        name += "/"
+    }
+
+    return f.create(name)
+}
+
 func (f *gofs_header) delete(name string) int {
     irp := f.generate_irp(name, nil, IRP_DELETE)
     if irp == nil {
@@ -340,31 +543,163 @@ func (f *gofs_header) write_internal(d *gofs_file, data []byte) int {
     d.data = make([]byte, len(data))
     copy(d.data, data)
     d.datasum = s(string(data))
+    d.mtime = time.Now().Unix()
 
     datalen := len(d.data)
 
     return datalen
 }
 
-func (f *gofs_header) unmount_db(filename *string) int {
-    var target_db_file string = *filename
-    if filename == nil {
-        target_db_file = f.filename
+/* write_at_internal writes data into d at byte offset off, growing d.data
+ * (zero-padded) if the write extends past the current end of file. Caller
+ * must hold d.lock. Growth goes through append rather than an exact-size
+ * make+copy, so it reallocates (and copies the existing bytes) only when
+ * d.data's spare capacity runs out, the same amortized-doubling behaviour
+ * append already gives regular slices. Every call still recomputes
+ * d.datasum over the whole file, so each write, however small, costs O(n)
+ * in the file's size. */
+func (f *gofs_header) write_at_internal(d *gofs_file, off int64, data []byte) {
+    old_len := uint(len(d.data))
+
+    end := off + int64(len(data))
+    if end > int64(len(d.data)) {
+        d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+    }
+
+    new_len := uint(len(d.data))
+    if new_len >= old_len {
+        f.t_size += new_len - old_len
+    } else {
+        f.t_size -= old_len - new_len
+    }
+
+    copy(d.data[off:end], data)
+    d.datasum = s(string(d.data))
+    d.mtime = time.Now().Unix()
+}
+
+/* truncate_internal resizes d.data to exactly size bytes. Caller must hold
+ * d.lock. */
+func (f *gofs_header) truncate_internal(d *gofs_file, size uint) {
+    if uint(len(d.data)) >= size {
+        f.t_size -= uint(len(d.data)) - size
+    } else {
+        f.t_size += size - uint(len(d.data))
+    }
+
+    resized := make([]byte, size)
+    copy(resized, d.data)
+    d.data = resized
+    d.datasum = s(string(d.data))
+    d.mtime = time.Now().Unix()
+}
+
+/* rename_internal re-keys old_name (and, if it is a directory, every
+ * descendant under old_name+"/") to new_name in f.meta. */
+func (f *gofs_header) rename_internal(old_name string, new_name string) int {
+    file := f.check(old_name)
+    if file == nil {
+        return STATUS_NOT_FOUND
+    }
+
+    if file.filetype == FLAG_DIRECTORY {
+        old_prefix := strings.TrimRight(old_name, "/") + "/"
+        new_prefix := strings.TrimRight(new_name, "/") + "/"
+
+        for k, child := range f.meta {
+            if child == nil || !strings.HasPrefix(child.filename, old_prefix) {
+                continue
+            }
+
+            child_new_name := new_prefix + strings.TrimPrefix(child.filename, old_prefix)
+            child.filename = child_new_name
+            delete(f.meta, k)
+            f.meta[s(child_new_name)] = child
+        }
+    }
+
+    file.filename = new_name
+    delete(f.meta, s(old_name))
+    f.meta[s(new_name)] = file
+    file.mtime = time.Now().Unix()
+
+    return STATUS_OK
+}
+
+/*
+ * unmount_db flushes the in-memory filesystem back to its container at
+ * target_db_file. flags is OR'd with FLAG_COMPRESS|FLAG_ENCRYPT (always
+ * on) -- pass FLAG_FEC/FLAG_FEC_FAST and/or FLAG_ENCRYPT_NAMES to enable
+ * those on top.
+ */
+func (f *gofs_header) unmount_db(filename *string, flags int) int {
+    target_db_file := f.filename
+    if filename != nil {
+        target_db_file = *filename
+    }
+
+    encrypt_names := flags & FLAG_ENCRYPT_NAMES != 0
+    var name_key []byte
+    if encrypt_names {
+        name_key = derive_name_key(f.passphrase, f.salt[:], f.kdf)
+    }
+    content_key := derive_content_key(f.passphrase, f.salt[:], f.kdf)
+
+    if f.chunk_size == 0 {
+        f.chunk_size = DEFAULT_CHUNK_SIZE
+    }
+
+    /* dir_iv_of looks up the DirIV of a plaintext ancestor directory path
+     * (no trailing slash), falling back to the container's root DirIV. */
+    dir_iv_of := func (ancestor string) [16]byte {
+        if dir := f.check(ancestor + "/"); dir != nil {
+            return dir.dir_iv
+        }
+        return f.root_dir_iv
     }
 
     type RawFile /* Capitalize for the sake of exporting */ struct {
         RawSum [16]byte
-        GZIPSize uint
         Flags int
         Name [MAX_FILENAME_LENGTH]byte
+        DirIV [16]byte /* This entry's own DirIV, set only when Flags == FLAG_DIRECTORY */
+        LongNameSize uint /* >0: Name holds a gocryptfs.longname.<sha256> marker, and the
+                              real LongNameSize-byte encrypted path chain follows this
+                              header (before the file's own data) in the stream */
+        FileID [16]byte /* Chunk nonces for this file are derived from FileID+index; see govfs_chunks.go */
+        ChunkSizes []uint32 /* Sealed length of each chunk, in order; the chunks themselves
+                                follow this record (after the long-name chain, if any) */
     }
 
     type comp_data struct {
         file *gofs_file
-        data_compressed []byte
+        data_chunks [][]byte /* Gzipped-then-sealed chunks, in order */
+        long_name []byte
         raw RawFile
     }
 
+    /* set_name fills in raw.Name (and, when FLAG_ENCRYPT_NAMES is set,
+     * raw.DirIV/long_name) for d.file. */
+    set_name := func (d *comp_data) {
+        if !encrypt_names {
+            copy(d.raw.Name[:], d.file.filename)
+            return
+        }
+
+        chain := encrypt_path_chain(d.file.filename, name_key, f.root_dir_iv, dir_iv_of)
+        if len(chain) > name_longname_threshold {
+            copy(d.raw.Name[:], longname_marker(chain))
+            d.long_name = []byte(chain)
+            d.raw.LongNameSize = uint(len(chain))
+        } else {
+            copy(d.raw.Name[:], chain)
+        }
+
+        if d.file.filetype == FLAG_DIRECTORY {
+            d.raw.DirIV = d.file.dir_iv
+        }
+    }
+
     commit_ch := make(chan *comp_data)
     for k := range f.meta {
         header := new(comp_data)
@@ -376,26 +711,32 @@ func (f *gofs_header) unmount_db(filename *string) int {
             }
 
             /*
-             * Perform compression of the file, and store it in 'd'
+             * Split the file into chunks, and gzip+seal each one independently
+             * into 'd' -- see govfs_chunks.go.
              */
             if d.file.filetype == FLAG_FILE /* File */ && len(d.file.data) > 0 {
-                /* Compression required since this is a file, and it's length is > 0 */
-                buf := func (data []byte) *bytes.Buffer {
-                    var output = new(bytes.Buffer)
-                    w := gzip.NewWriter(output)
-                    w.Write(d.file.data)
+                /* content_key is the same on every unmount, so a fresh id keeps
+                 * (content_key, chunk nonce) pairs from repeating across seals */
+                d.file.file_id = random_file_id()
+                for i, chunk := range split_chunks(d.file.data, f.chunk_size) {
+                    var compressed = new(bytes.Buffer)
+                    w := gzip.NewWriter(compressed)
+                    w.Write(chunk)
                     w.Close()
 
-                    return output
-                } (d.file.data)
+                    sealed, status := seal_chunk(compressed.Bytes(), content_key, d.file.file_id, uint64(i))
+                    if status != STATUS_OK {
+                        continue /* AES-GCM init failure -- should not happen with a valid content_key */
+                    }
 
-                d.data_compressed = make([]byte, buf.Len())
-                buf.Write(d.data_compressed)
+                    d.data_chunks = append(d.data_chunks, sealed)
+                    d.raw.ChunkSizes = append(d.raw.ChunkSizes, uint32(len(sealed)))
+                }
 
                 d.raw.RawSum = md5.Sum(d.file.data)
-                d.raw.GZIPSize = uint(len(d.data_compressed))
                 d.raw.Flags = FLAG_FILE
-                copy(d.raw.Name[:], d.file.filename)
+                d.raw.FileID = d.file.file_id
+                set_name(d)
 
                 commit_ch <- d
             }
@@ -403,14 +744,15 @@ func (f *gofs_header) unmount_db(filename *string) int {
             if d.file.filetype == FLAG_DIRECTORY {
                 /* Directory type file. No need for compression, but the metadata must exist */
                 d.raw.Flags = FLAG_DIRECTORY
-                copy(d.raw.Name[:], d.file.filename)
+                set_name(d)
                 commit_ch <- d
             }
 
             if d.file.filetype == FLAG_FILE && len(d.file.data) == 0 {
-                /* Empty file. Does not need compression but metadata must exist */
+                /* Empty file. No chunks needed but metadata must exist */
                 d.raw.Flags = FLAG_FILE
-                copy(d.raw.Name[:], d.file.filename)
+                d.raw.FileID = d.file.file_id
+                set_name(d)
                 commit_ch <- d
             }
         }(header)
@@ -425,38 +767,43 @@ func (f *gofs_header) unmount_db(filename *string) int {
     type fs_header struct {
         Signature string /* Uppercase so that it's "exported" i.e. visibile to the encoder */
         FileCount uint
+        RootDirIV [16]byte /* Only meaningful when FLAG_ENCRYPT_NAMES is set */
+        NameCheck [32]byte /* Ditto -- lets mount_db detect a bad name_key before it decrypts garbage */
     }
     hdr := fs_header {
         Signature:  FS_SIGNATURE, /* This signature may be modified in the configuration -- FIXME */
         FileCount:  total_files }
+    if encrypt_names {
+        hdr.RootDirIV = f.root_dir_iv
+        hdr.NameCheck = name_check(name_key, f.root_dir_iv)
+    }
 
-    /* Serializer for fs_header */
-    stream := func (object interface{}) *bytes.Buffer {
-        b := new(bytes.Buffer)
-        e := gob.NewEncoder(b)
-        if err := e.Encode(object); err != nil {
-            return nil /* Failure in encoding the fs_header structure -- Should not happen */
-        }
-
-        return b
-    } (hdr)
+    /* A single gob.Encoder writes the fs_header followed by every RawFile:
+     * encoding each record through its own fresh Encoder (as earlier
+     * versions of this function did) makes every one of them re-announce
+     * its wire type starting at the same type id, which collides on
+     * decode ("gob: duplicate type received") as soon as a different type
+     * has already claimed that id -- a single shared session avoids that. */
+    stream := new(bytes.Buffer)
+    enc := gob.NewEncoder(stream)
+    if err := enc.Encode(hdr); err != nil {
+        return STATUS_FS_WRITE /* Failure in encoding the fs_header structure -- Should not happen */
+    }
 
     for total_files != 0 {
         var header = <- commit_ch
 
-        /* Append the header */
-        serialized_fileheader := func (object interface{}) *bytes.Buffer {
-            b := new(bytes.Buffer)
-            e := gob.NewEncoder(b)
-            if err := e.Encode(object); err != nil {
-                return nil /* This should be an assertion -- FIXME */
-            }
-            return b
-        } (header.raw) /* Pass in RawFile */
-        stream.Write(serialized_fileheader.Bytes())
+        if err := enc.Encode(header.raw); err != nil {
+            return STATUS_FS_WRITE
+        }
 
-        /* Append the compressed data */
-        stream.Write(header.data_compressed)
+        /* Append the long-name chain, if any, then each sealed chunk in order */
+        if header.raw.LongNameSize > 0 {
+            stream.Write(header.long_name)
+        }
+        for _, chunk := range header.data_chunks {
+            stream.Write(chunk)
+        }
 
         total_files -= 1
     }
@@ -464,7 +811,7 @@ func (f *gofs_header) unmount_db(filename *string) int {
     close(commit_ch)
 
     /* Compress, encrypt, and write stream */
-    if _, l := f.write_fs_stream(target_db_file, stream, FLAG_COMPRESS | FLAG_ENCRYPT); l != STATUS_OK {
+    if _, l := f.write_fs_stream(target_db_file, stream, flags | FLAG_COMPRESS | FLAG_ENCRYPT); l != STATUS_OK {
         return STATUS_FS_WRITE
     }
 
@@ -472,7 +819,7 @@ func (f *gofs_header) unmount_db(filename *string) int {
 }
 
 func (f *gofs_header) write_fs_stream(name string, data *bytes.Buffer, flags int) (uint, int) {
-    if flags != FLAG_ENCRYPT | FLAG_COMPRESS {
+    if flags & (FLAG_ENCRYPT | FLAG_COMPRESS) != (FLAG_ENCRYPT | FLAG_COMPRESS) {
         return 0, STATUS_FS_ENC_COMP // FIXME
     }
 
@@ -481,35 +828,11 @@ func (f *gofs_header) write_fs_stream(name string, data *bytes.Buffer, flags int
     w.Write(data.Bytes())
     w.Close()
 
-    /* The AES key will be the MD5 of the hostname string + the FS_SIGNATURE string */
-    key := func () []byte {
-        host, _ := os.Hostname()
-        host += FS_SIGNATURE
-
-        sum := md5.Sum([]byte(host))
-        output := make([]byte, len(sum))
-        copy(output, sum[:])
-        return output
-    } ()
-
-    /* Generate a pad of a 16byte blocksize */
-    pad := make([]byte, compressed.Len() + (aes.BlockSize - compressed.Len() % aes.BlockSize))
-    copy(pad, compressed.Bytes())
-
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        return 0, STATUS_FS_ENC_COMP
-    }
-
-    ciphertext := make([]byte, aes.BlockSize + len(pad))
-    iv := ciphertext[:aes.BlockSize]
-    if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-        return 0, STATUS_FS_ENC_COMP
+    sealed, status := seal_container(compressed.Bytes(), f.passphrase, f.salt, f.kdf)
+    if status != STATUS_OK {
+        return 0, status
     }
 
-    mode := cipher.NewCBCEncrypter(block, iv)
-    mode.CryptBlocks(ciphertext[aes.BlockSize:], pad)
-
     if _, err := os.Stat(name); os.IsExist(err) {
         os.Remove(name)
     }
@@ -520,7 +843,21 @@ func (f *gofs_header) write_fs_stream(name string, data *bytes.Buffer, flags int
     }
     defer file.Close()
 
-    written, err := file.Write(ciphertext)
+    if flags & FLAG_FEC != 0 {
+        shares, status := fec_encode_container(sealed, fs_container_hdr_size)
+        if status != STATUS_OK {
+            return 0, status
+        }
+
+        written, err := file.Write(shares)
+        if err != nil {
+            return uint(written), STATUS_FS_ENC_COMP
+        }
+
+        return uint(written), STATUS_OK
+    }
+
+    written, err := file.Write(sealed)
     if err != nil {
         return uint(written), STATUS_FS_ENC_COMP
     }
@@ -528,6 +865,233 @@ func (f *gofs_header) write_fs_stream(name string, data *bytes.Buffer, flags int
     return uint(written), STATUS_OK
 }
 
+/*
+ * read_fs_stream is the inverse of write_fs_stream: it loads the on-disk
+ * container, undoes the FEC layer (if present), opens the Argon2id/AES-GCM
+ * sealed header+payload, and inflates the gzip stream so the caller gets
+ * back the raw gob stream produced by unmount_db.
+ */
+func (f *gofs_header) read_fs_stream(name string, flags int) (*bytes.Buffer, int) {
+    raw, err := os.ReadFile(name)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    sealed := raw
+    if flags & FLAG_FEC != 0 {
+        decoded, status := fec_decode_container(raw, fs_container_hdr_size, flags & FLAG_FEC_FAST != 0)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        sealed = decoded
+    }
+
+    /* Recover the salt actually stored in the container, rather than
+     * trusting whatever f.salt happened to be -- this matters for mount_db,
+     * which does not otherwise know the salt create_db originally picked. */
+    if len(sealed) >= 17 {
+        copy(f.salt[:], sealed[1:17])
+    }
+
+    pad, status := open_container(sealed, f.passphrase, f.kdf)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    gz, err := gzip.NewReader(bytes.NewReader(pad))
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+    defer gz.Close()
+
+    output := new(bytes.Buffer)
+    if _, err := io.Copy(output, gz); err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    return output, STATUS_OK
+}
+
+/*
+ * mount_db loads a container written by unmount_db back into an in-memory
+ * gofs_header. passphrase and params must match what create_db used to
+ * write it -- a wrong passphrase surfaces as STATUS_AUTH_FAIL rather than
+ * garbage data. Pass the same flags that were used to write the container
+ * (FLAG_ENCRYPT|FLAG_COMPRESS, optionally FLAG_FEC/FLAG_FEC_FAST).
+ */
+func mount_db(filename string, passphrase string, params KDFParams, flags int) (*gofs_header, int) {
+    header := new(gofs_header)
+    header.filename = filename
+    header.meta = make(map[string]*gofs_file)
+    header.meta[s("/")] = new(gofs_file)
+    header.meta[s("/")].filename = "/"
+    header.passphrase = passphrase
+    header.kdf = params
+    header.chunk_size = DEFAULT_CHUNK_SIZE
+
+    stream, status := header.read_fs_stream(filename, flags)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    type RawFile struct {
+        RawSum [16]byte
+        Flags int
+        Name [MAX_FILENAME_LENGTH]byte
+        DirIV [16]byte
+        LongNameSize uint
+        FileID [16]byte
+        ChunkSizes []uint32
+    }
+
+    type fs_header struct {
+        Signature string
+        FileCount uint
+        RootDirIV [16]byte
+        NameCheck [32]byte
+    }
+
+    dec := gob.NewDecoder(stream)
+
+    var hdr fs_header
+    if err := dec.Decode(&hdr); err != nil || hdr.Signature != FS_SIGNATURE {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    encrypt_names := flags & FLAG_ENCRYPT_NAMES != 0
+    var name_key []byte
+    if encrypt_names {
+        name_key = derive_name_key(passphrase, header.salt[:], params)
+        if name_check(name_key, hdr.RootDirIV) != hdr.NameCheck {
+            return nil, STATUS_AUTH_FAIL
+        }
+        header.root_dir_iv = hdr.RootDirIV
+    }
+    content_key := derive_content_key(passphrase, header.salt[:], params)
+
+    /* pending holds every entry's still-encrypted chain until all of them
+     * have been read, so each entry can resolve its plaintext path without
+     * depending on the (arbitrary) order entries were written in. */
+    type pending_entry struct {
+        raw RawFile
+        chain string
+        chunks [][]byte
+    }
+    pending := make([]*pending_entry, 0, hdr.FileCount)
+
+    for i := uint(0); i < hdr.FileCount; i++ {
+        var raw RawFile
+        if err := dec.Decode(&raw); err != nil {
+            return nil, STATUS_FS_ENC_COMP
+        }
+
+        chain := strings.TrimRight(string(raw.Name[:]), "\x00")
+        if raw.LongNameSize > 0 {
+            long_chain := make([]byte, raw.LongNameSize)
+            if _, err := io.ReadFull(stream, long_chain); err != nil {
+                return nil, STATUS_FS_ENC_COMP
+            }
+            chain = string(long_chain)
+        }
+
+        var chunks [][]byte
+        if raw.Flags == FLAG_FILE {
+            chunks = make([][]byte, len(raw.ChunkSizes))
+            for i, size := range raw.ChunkSizes {
+                chunks[i] = make([]byte, size)
+                if _, err := io.ReadFull(stream, chunks[i]); err != nil {
+                    return nil, STATUS_FS_ENC_COMP
+                }
+            }
+        }
+
+        pending = append(pending, &pending_entry{raw: raw, chain: chain, chunks: chunks})
+    }
+
+    /* dir_ivs maps a directory's own (still-encrypted) chain to its DirIV,
+     * so any entry below it can decrypt its own segment regardless of read
+     * order -- see resolve_encrypted_path. */
+    dir_ivs := map[string][16]byte{"": hdr.RootDirIV}
+    if encrypt_names {
+        for _, p := range pending {
+            if p.raw.Flags == FLAG_DIRECTORY {
+                dir_ivs[p.chain] = p.raw.DirIV
+            }
+        }
+    }
+
+    for _, p := range pending {
+        name := p.chain
+        if encrypt_names {
+            resolved, ok := resolve_encrypted_path(p.chain, name_key, dir_ivs)
+            if !ok {
+                return nil, STATUS_FS_ENC_COMP
+            }
+            name = resolved
+            if p.raw.Flags == FLAG_DIRECTORY {
+                name += "/"
+            }
+        }
+
+        file := new(gofs_file)
+        file.filename = name
+        file.filetype = p.raw.Flags
+        if p.raw.Flags == FLAG_DIRECTORY {
+            file.mode = DEFAULT_DIR_MODE
+            file.dir_iv = p.raw.DirIV
+        } else {
+            file.mode = DEFAULT_FILE_MODE
+            file.file_id = p.raw.FileID
+        }
+        file.mtime = time.Now().Unix()
+
+        if p.raw.Flags == FLAG_FILE && len(p.chunks) > 0 {
+            var decompressed bytes.Buffer
+            for i, sealed := range p.chunks {
+                compressed, status := open_chunk(sealed, content_key, p.raw.FileID, uint64(i))
+                if status != STATUS_OK {
+                    return nil, status
+                }
+
+                gz, err := gzip.NewReader(bytes.NewReader(compressed))
+                if err != nil {
+                    return nil, STATUS_FS_ENC_COMP
+                }
+
+                if _, err := io.Copy(&decompressed, gz); err != nil {
+                    gz.Close()
+                    return nil, STATUS_FS_ENC_COMP
+                }
+                gz.Close()
+            }
+
+            file.data = decompressed.Bytes()
+            file.datasum = s(string(file.data))
+            header.t_size += uint(len(file.data))
+        }
+
+        header.meta[s(name)] = file
+    }
+
+    header.io_in = make(chan *gofs_io_block)
+    go func (f *gofs_header) {
+        for {
+            var io = <- header.io_in
+            if !f.process_irp(io) {
+                return
+            }
+        }
+    } (header)
+
+    return header, STATUS_OK
+}
+
+/* set_chunk_size overrides the chunk size used the next time this
+ * header's files are split and sealed by unmount_db. */
+func (f *gofs_header) set_chunk_size(size uint) {
+    f.chunk_size = size
+}
+
 func (f *gofs_header) get_file_count() uint {
     var total uint = 0
     for range f.meta {
@@ -546,6 +1110,70 @@ func (f *gofs_header) get_file_size(name string) (uint, int) {
     return uint(len(file.data)), STATUS_OK
 }
 
+/* fs_stat is the attribute set a FUSE Getattr/Lookup needs and that the
+ * flat []byte-per-file model above doesn't otherwise expose. */
+type fs_stat struct {
+    name    string
+    size    uint
+    mode    uint32
+    mtime   int64
+    is_dir  bool
+}
+
+func (f *gofs_header) stat(name string) (*fs_stat, int) {
+    file := f.check(name)
+    if file == nil {
+        return nil, STATUS_NOT_FOUND
+    }
+
+    return &fs_stat{
+        name:   file.filename,
+        size:   uint(len(file.data)),
+        mode:   file.mode,
+        mtime:  file.mtime,
+        is_dir: file.filetype == FLAG_DIRECTORY,
+    }, STATUS_OK
+}
+
+/* readdir lists the direct children of dir (a path with or without a
+ * trailing slash). Used by the FUSE frontend's Readdir. */
+func (f *gofs_header) readdir(dir string) ([]*fs_stat, int) {
+    if dir != "/" && f.check(dir) == nil {
+        return nil, STATUS_NOT_FOUND
+    }
+
+    prefix := dir
+    if !strings.HasSuffix(prefix, "/") {
+        prefix += "/"
+    }
+
+    var out []*fs_stat
+    for _, file := range f.meta {
+        if file == nil || file.filename == "/" || file.filename == prefix {
+            continue
+        }
+
+        if !strings.HasPrefix(file.filename, prefix) {
+            continue
+        }
+
+        rest := strings.TrimSuffix(strings.TrimPrefix(file.filename, prefix), "/")
+        if rest == "" || strings.Contains(rest, "/") {
+            continue /* not a direct child of dir */
+        }
+
+        out = append(out, &fs_stat{
+            name:   rest,
+            size:   uint(len(file.data)),
+            mode:   file.mode,
+            mtime:  file.mtime,
+            is_dir: file.filetype == FLAG_DIRECTORY,
+        })
+    }
+
+    return out, STATUS_OK
+}
+
 func (f *gofs_header) get_total_filesizes() uint {
     return f.t_size
 }
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+import "io"
+
+/* govfs_api.go -- the exported surface of the package. Apart from its
+ * constants and KDFParams, everything else in gofs is unexported
+ * (gofs_header, create_db, ...); this file
+ * is the thin public facade external consumers -- first and foremost
+ * gofs/fuse -- are meant to build against, so the internal representation
+ * stays free to change underneath it.
+ */
+
+/* Header is a handle to a mounted or newly created govfs container. */
+type Header struct {
+    h *gofs_header
+}
+
+/* Stat mirrors the subset of POSIX file attributes gofs tracks. */
+type Stat struct {
+    Name  string
+    Size  uint
+    Mode  uint32
+    Mtime int64
+    IsDir bool
+}
+
+/* CreateDB starts a brand new in-memory filesystem backed by filename,
+ * encrypted under passphrase with the given KDF cost parameters. */
+func CreateDB(filename string, passphrase string, params KDFParams) *Header {
+    return &Header{h: create_db(filename, passphrase, params)}
+}
+
+/* MountDB loads a container previously written by (*Header).Unmount. flags
+ * must match what it was written with, e.g. FLAG_ENCRYPT|FLAG_COMPRESS,
+ * optionally OR'd with FLAG_FEC/FLAG_FEC_FAST. */
+func MountDB(filename string, passphrase string, params KDFParams, flags int) (*Header, int) {
+    h, status := mount_db(filename, passphrase, params, flags)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    return &Header{h: h}, STATUS_OK
+}
+
+/* DefaultKDFParams returns gofs's recommended Argon2id cost parameters. */
+func DefaultKDFParams() KDFParams {
+    return default_kdf_params()
+}
+
+func (header *Header) Create(name string) int {
+    _, status := header.h.create(name)
+    return status
+}
+
+func (header *Header) Mkdir(name string) int {
+    _, status := header.h.mkdir(name)
+    return status
+}
+
+func (header *Header) Delete(name string) int {
+    return header.h.delete(name)
+}
+
+func (header *Header) Rename(old_name string, new_name string) int {
+    return header.h.rename(old_name, new_name)
+}
+
+func (header *Header) Read(name string) ([]byte, int) {
+    return header.h.read(name)
+}
+
+func (header *Header) ReadAt(name string, off int64, p []byte) (int, int) {
+    return header.h.read_at(name, off, p)
+}
+
+func (header *Header) Write(name string, d []byte) int {
+    return header.h.write(name, d)
+}
+
+func (header *Header) WriteAt(name string, off int64, d []byte) (int, int) {
+    return header.h.write_at(name, off, d)
+}
+
+func (header *Header) Truncate(name string, size uint) int {
+    return header.h.truncate(name, size)
+}
+
+/* SetChunkSize overrides the chunk size (default DEFAULT_CHUNK_SIZE) files
+ * are split into when this header is next written out by Unmount. */
+func (header *Header) SetChunkSize(size uint) {
+    header.h.set_chunk_size(size)
+}
+
+func (header *Header) Stat(name string) (Stat, int) {
+    st, status := header.h.stat(name)
+    if status != STATUS_OK {
+        return Stat{}, status
+    }
+
+    return Stat{Name: st.name, Size: st.size, Mode: st.mode, Mtime: st.mtime, IsDir: st.is_dir}, STATUS_OK
+}
+
+func (header *Header) List() []string {
+    return header.h.get_file_list()
+}
+
+/* ReadDir lists the direct children of dir (with or without a trailing
+ * slash), for FUSE Readdir. */
+func (header *Header) ReadDir(dir string) ([]Stat, int) {
+    entries, status := header.h.readdir(dir)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    out := make([]Stat, 0, len(entries))
+    for _, st := range entries {
+        out = append(out, Stat{Name: st.name, Size: st.size, Mode: st.mode, Mtime: st.mtime, IsDir: st.is_dir})
+    }
+
+    return out, STATUS_OK
+}
+
+/* ImportZip bulk-loads every entry of a zip archive (backed by r, with
+ * total size size) into header, creating intermediate directories as
+ * needed. */
+func (header *Header) ImportZip(r io.ReaderAt, size int64) int {
+    return header.h.import_zip(r, size)
+}
+
+/* ExportZip streams header's files and directories out as a zip archive. */
+func (header *Header) ExportZip(w io.Writer) int {
+    return header.h.export_zip(w)
+}
+
+/* ImportTar bulk-loads every entry of a tar stream into header, creating
+ * intermediate directories as needed. */
+func (header *Header) ImportTar(r io.Reader) int {
+    return header.h.import_tar(r)
+}
+
+/* ExportTar streams header's files and directories out as a tar archive. */
+func (header *Header) ExportTar(w io.Writer) int {
+    return header.h.export_tar(w)
+}
+
+/* Unmount flushes the in-memory filesystem back to the encrypted container
+ * at filename (or the container's original path if filename is nil). flags
+ * is OR'd with FLAG_COMPRESS|FLAG_ENCRYPT (always on); pass FLAG_FEC,
+ * FLAG_FEC_FAST and/or FLAG_ENCRYPT_NAMES to enable those on top -- the same
+ * flags must then be passed back into MountDB. */
+func (header *Header) Unmount(filename *string, flags int) int {
+    return header.h.unmount_db(filename, flags)
+}
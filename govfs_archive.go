@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+/* govfs_archive.go -- bulk zip/tar import and export, so a .gofs container
+ * can be populated from (or dumped back out to) an archive in one call
+ * instead of walking it by hand with create()/write(). Both zip and tar
+ * import walk their entries sequentially: f.meta is only safe to mutate
+ * from inside the IRP goroutine, but f.check() (used by create()/write()
+ * to look up an existing entry) reads it directly from the caller's
+ * goroutine, so importing entries concurrently races f.meta.
+ *
+ * Every entry this package holds in memory is plaintext (the same
+ * tradeoff govfs_names.go and govfs_chunks.go make: compression and
+ * encryption only happen at the unmount_db serialization boundary), so
+ * export always re-deflates each file rather than re-using an
+ * already-compressed copy.
+ */
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "io"
+    "os"
+    "strings"
+    "time"
+)
+
+/* import_zip reads every entry out of a zip archive (backed by r, with
+ * total size size) and creates it in f, auto-vivifying intermediate
+ * directories the same way create() already does for any nested path. */
+func (f *gofs_header) import_zip(r io.ReaderAt, size int64) int {
+    zr, err := zip.NewReader(r, size)
+    if err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    status := STATUS_OK
+    for _, zf := range zr.File {
+        if s := f.import_zip_entry(zf); s != STATUS_OK && status == STATUS_OK {
+            status = s
+        }
+    }
+
+    return status
+}
+
+func (f *gofs_header) import_zip_entry(zf *zip.File) int {
+    name := "/" + strings.TrimPrefix(zf.Name, "/")
+
+    if zf.FileInfo().IsDir() {
+        if _, status := f.mkdir(name); status != STATUS_OK && status != STATUS_EXISTS {
+            return status
+        }
+        return STATUS_OK
+    }
+
+    rc, err := zf.Open()
+    if err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+    defer rc.Close()
+
+    data, err := io.ReadAll(rc)
+    if err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    if _, status := f.create(name); status != STATUS_OK && status != STATUS_EXISTS {
+        return status
+    }
+
+    return f.write(name, data)
+}
+
+/* export_zip streams every file and directory in f into a zip archive
+ * written to w. */
+func (f *gofs_header) export_zip(w io.Writer) int {
+    zw := zip.NewWriter(w)
+
+    for _, file := range f.meta {
+        if file == nil || file.filename == "/" {
+            continue
+        }
+
+        if status := export_zip_entry(zw, file); status != STATUS_OK {
+            zw.Close()
+            return status
+        }
+    }
+
+    if err := zw.Close(); err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    return STATUS_OK
+}
+
+func export_zip_entry(zw *zip.Writer, file *gofs_file) int {
+    name := strings.TrimPrefix(file.filename, "/")
+
+    if file.filetype == FLAG_DIRECTORY {
+        hdr := &zip.FileHeader{Name: strings.TrimSuffix(name, "/") + "/"}
+        hdr.SetMode(os.FileMode(file.mode) | os.ModeDir)
+        hdr.Modified = time.Unix(file.mtime, 0)
+
+        if _, err := zw.CreateHeader(hdr); err != nil {
+            return STATUS_ARCHIVE_ERROR
+        }
+        return STATUS_OK
+    }
+
+    hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+    hdr.SetMode(os.FileMode(file.mode))
+    hdr.Modified = time.Unix(file.mtime, 0)
+
+    out, err := zw.CreateHeader(hdr)
+    if err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    if _, err := out.Write(file.data); err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    return STATUS_OK
+}
+
+/* import_tar reads every entry out of a tar stream and creates it in f.
+ * Like import_zip, entries are created one at a time, in the order the
+ * stream yields them. */
+func (f *gofs_header) import_tar(r io.Reader) int {
+    tr := tar.NewReader(r)
+    status := STATUS_OK
+
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return STATUS_ARCHIVE_ERROR
+        }
+
+        name := "/" + strings.TrimPrefix(hdr.Name, "/")
+
+        if hdr.Typeflag == tar.TypeDir {
+            if _, s := f.mkdir(name); s != STATUS_OK && s != STATUS_EXISTS && status == STATUS_OK {
+                status = s
+            }
+            continue
+        }
+
+        data, err := io.ReadAll(tr)
+        if err != nil {
+            return STATUS_ARCHIVE_ERROR
+        }
+
+        if _, s := f.create(name); s != STATUS_OK && s != STATUS_EXISTS {
+            if status == STATUS_OK {
+                status = s
+            }
+            continue
+        }
+
+        if s := f.write(name, data); s != STATUS_OK && status == STATUS_OK {
+            status = s
+        }
+    }
+
+    return status
+}
+
+/* export_tar streams every file and directory in f into a tar archive
+ * written to w. */
+func (f *gofs_header) export_tar(w io.Writer) int {
+    tw := tar.NewWriter(w)
+
+    for _, file := range f.meta {
+        if file == nil || file.filename == "/" {
+            continue
+        }
+
+        if status := export_tar_entry(tw, file); status != STATUS_OK {
+            tw.Close()
+            return status
+        }
+    }
+
+    if err := tw.Close(); err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    return STATUS_OK
+}
+
+func export_tar_entry(tw *tar.Writer, file *gofs_file) int {
+    name := strings.TrimPrefix(file.filename, "/")
+
+    hdr := &tar.Header{
+        Name:    name,
+        Mode:    int64(file.mode),
+        ModTime: time.Unix(file.mtime, 0),
+    }
+
+    if file.filetype == FLAG_DIRECTORY {
+        hdr.Name = strings.TrimSuffix(name, "/") + "/"
+        hdr.Typeflag = tar.TypeDir
+    } else {
+        hdr.Typeflag = tar.TypeReg
+        hdr.Size = int64(len(file.data))
+    }
+
+    if err := tw.WriteHeader(hdr); err != nil {
+        return STATUS_ARCHIVE_ERROR
+    }
+
+    if file.filetype != FLAG_DIRECTORY {
+        if _, err := tw.Write(file.data); err != nil {
+            return STATUS_ARCHIVE_ERROR
+        }
+    }
+
+    return STATUS_OK
+}
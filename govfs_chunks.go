@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+/* govfs_chunks.go -- splits a file's data into fixed-size chunks at the
+ * unmount_db/mount_db serialization boundary (the same boundary
+ * govfs_names.go encrypts filenames at), each chunk gzipped and then
+ * AEAD-sealed on its own, mirroring the per-block layout gocryptfs's
+ * contentenc uses. A chunk's nonce is derived from the owning file's
+ * FileID and the chunk's index rather than stored, so unmount_db never
+ * has to persist one more thing per chunk than its sealed length.
+ *
+ * This bounds the gzip work to chunk_size at a time, but unmount_db still
+ * re-seals every chunk of every file each time it runs, and it is not a
+ * streaming format: gofs_file.data still holds a file's entire plaintext
+ * in memory the whole time it is open (write_at_internal grows it with
+ * append's amortized-doubling, but still rehashes the whole buffer on
+ * every call, and the buffer is one contiguous slice, not real chunks),
+ * and unmount_db still assembles every sealed chunk of every file into
+ * one in-memory stream before write_fs_stream gzips and AEAD-seals that
+ * stream as a single container body. A file, or
+ * a whole container, larger than available RAM is still not supported --
+ * that would need the outer container seal itself (see seal_container in
+ * govfs_crypto.go) reworked into a chunked AEAD framing, not just this.
+ */
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "io"
+
+    "golang.org/x/crypto/hkdf"
+)
+
+/* DEFAULT_CHUNK_SIZE is used unless a header's chunk_size has been changed
+ * with Header.SetChunkSize. */
+const DEFAULT_CHUNK_SIZE uint = 64 * 1024
+
+/* derive_content_key stretches the same Argon2id master key used for the
+ * container and the name key into a distinct 256-bit AES-GCM key for
+ * sealing file chunks, via its own HKDF info string. */
+func derive_content_key(passphrase string, salt []byte, params KDFParams) []byte {
+    enc_key, _ := derive_keys(passphrase, salt, params)
+
+    content_key := make([]byte, 32)
+    io.ReadFull(hkdf.New(sha256.New, enc_key, nil, []byte("govfs-content-key")), content_key)
+    return content_key
+}
+
+/* random_file_id generates the per-file identifier chunk nonces are tied
+ * to. unmount_db draws a fresh one for a file each time it seals it, since
+ * content_key stays the same across unmounts; it is not stable across
+ * unmounts. */
+func random_file_id() [16]byte {
+    var id [16]byte
+    io.ReadFull(rand.Reader, id[:])
+    return id
+}
+
+/* chunk_nonce derives this chunk's 96-bit GCM nonce from its owning
+ * file's id and index, so unmount_db does not need to store (or the
+ * container's AEAD layer does not need to additionally authenticate) a
+ * random nonce per chunk. */
+func chunk_nonce(file_id [16]byte, index uint64) [12]byte {
+    var idx [8]byte
+    binary.BigEndian.PutUint64(idx[:], index)
+
+    sum := sha256.Sum256(append(file_id[:], idx[:]...))
+
+    var nonce [12]byte
+    copy(nonce[:], sum[:12])
+    return nonce
+}
+
+/* split_chunks divides data into chunk_size-byte pieces, the last one
+ * short if data does not divide evenly. Returns nil for empty data. */
+func split_chunks(data []byte, chunk_size uint) [][]byte {
+    if len(data) == 0 {
+        return nil
+    }
+
+    var chunks [][]byte
+    for off := 0; off < len(data); off += int(chunk_size) {
+        end := off + int(chunk_size)
+        if end > len(data) {
+            end = len(data)
+        }
+        chunks = append(chunks, data[off:end])
+    }
+
+    return chunks
+}
+
+/* seal_chunk AES-256-GCM seals plain under content_key, using the nonce
+ * derived from file_id and index. */
+func seal_chunk(plain []byte, content_key []byte, file_id [16]byte, index uint64) ([]byte, int) {
+    block, err := aes.NewCipher(content_key)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    nonce := chunk_nonce(file_id, index)
+    return gcm.Seal(nil, nonce[:], plain, nil), STATUS_OK
+}
+
+/* open_chunk is the inverse of seal_chunk. A bad content_key or a
+ * truncated/corrupted chunk comes back as STATUS_AUTH_FAIL. */
+func open_chunk(sealed []byte, content_key []byte, file_id [16]byte, index uint64) ([]byte, int) {
+    block, err := aes.NewCipher(content_key)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    nonce := chunk_nonce(file_id, index)
+    plain, err := gcm.Open(nil, nonce[:], sealed, nil)
+    if err != nil {
+        return nil, STATUS_AUTH_FAIL
+    }
+
+    return plain, STATUS_OK
+}
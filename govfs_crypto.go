@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+/* govfs_crypto.go -- passphrase-based key hierarchy for the container.
+ * Replaces the old md5(hostname + FS_SIGNATURE) AES-CBC scheme: the master
+ * key is derived with Argon2id from a passphrase and a random per-container
+ * salt, two independent subkeys come out of it via HKDF-SHA256 (one for
+ * AES-256-GCM, one for authenticating the cleartext header), so a corrupted
+ * or tampered container is rejected instead of silently decrypted.
+ */
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "io"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/hkdf"
+)
+
+/* fs_container_version is bumped whenever the on-disk header layout changes,
+ * so mount_db can reject containers it no longer knows how to read. */
+const fs_container_version byte = 2
+
+/* version(1) + salt(16) + nonce(12) + header hmac(32) */
+const fs_container_hdr_size int = 1 + 16 + 12 + 32
+
+type KDFParams struct {
+    Passes      uint32
+    MemoryKiB   uint32
+    Parallelism uint8
+}
+
+/* default_kdf_params mirrors Argon2id's recommended interactive-but-sturdy
+ * settings: ~4 passes over 256 MiB, 4-way parallel. */
+func default_kdf_params() KDFParams {
+    return KDFParams{Passes: 4, MemoryKiB: 256 * 1024, Parallelism: 4}
+}
+
+/* derive_keys stretches passphrase+salt into a 32-byte Argon2id master key,
+ * then splits it into an encryption subkey and a MAC subkey via HKDF-SHA256. */
+func derive_keys(passphrase string, salt []byte, params KDFParams) (enc_key []byte, mac_key []byte) {
+    master := argon2.IDKey([]byte(passphrase), salt, params.Passes, params.MemoryKiB, params.Parallelism, 32)
+
+    enc_key = make([]byte, 32)
+    io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("govfs-encryption-key")), enc_key)
+
+    mac_key = make([]byte, 32)
+    io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("govfs-mac-key")), mac_key)
+
+    return enc_key, mac_key
+}
+
+/* seal_container AEAD-encrypts plaintext under keys derived from passphrase
+ * and salt, and returns version||salt||nonce||header_hmac||ciphertext. */
+func seal_container(plaintext []byte, passphrase string, salt [16]byte, params KDFParams) ([]byte, int) {
+    enc_key, mac_key := derive_keys(passphrase, salt[:], params)
+
+    block, err := aes.NewCipher(enc_key)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    hdr := make([]byte, 0, fs_container_hdr_size)
+    hdr = append(hdr, fs_container_version)
+    hdr = append(hdr, salt[:]...)
+    hdr = append(hdr, nonce...)
+
+    mac := hmac.New(sha256.New, mac_key)
+    mac.Write(hdr)
+    hdr = append(hdr, mac.Sum(nil)...)
+
+    ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+
+    return append(hdr, ciphertext...), STATUS_OK
+}
+
+/* open_container is the inverse of seal_container: it checks the version
+ * byte, verifies the header HMAC, then opens the AEAD payload. Any mismatch
+ * -- wrong passphrase, bit-flipped header, truncated/tampered ciphertext --
+ * comes back as STATUS_AUTH_FAIL rather than garbage plaintext. */
+func open_container(raw []byte, passphrase string, params KDFParams) ([]byte, int) {
+    if len(raw) < fs_container_hdr_size {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    if raw[0] != fs_container_version {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    salt := raw[1:17]
+    nonce := raw[17:29]
+    tag := raw[29:fs_container_hdr_size]
+    ciphertext := raw[fs_container_hdr_size:]
+
+    enc_key, mac_key := derive_keys(passphrase, salt, params)
+
+    mac := hmac.New(sha256.New, mac_key)
+    mac.Write(raw[:29])
+    if !hmac.Equal(mac.Sum(nil), tag) {
+        return nil, STATUS_AUTH_FAIL
+    }
+
+    block, err := aes.NewCipher(enc_key)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+    if err != nil {
+        return nil, STATUS_AUTH_FAIL
+    }
+
+    return plaintext, STATUS_OK
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+/* govfs_fec.go -- optional Reed-Solomon FEC layer (FLAG_FEC) wrapped around
+ * the AES ciphertext produced by write_fs_stream, mirroring the
+ * shard-per-container approach used by Picocrypt. This is an erasure code,
+ * not a blind error-corrector: bit rot is modeled as "this encoded block
+ * failed its parity check", and recovered by brute-forcing which single byte
+ * of the block was the erasure. That is enough to survive the isolated
+ * single-byte corruption that bit rot/a bad sector typically produces; it is
+ * not a general-purpose multi-error decoder.
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+
+    "github.com/klauspost/reedsolomon"
+)
+
+/* The caller's critical header (container version/salt/nonce/hmac, plus an
+ * 8-byte trailer recording the body length) gets a 2x-heavy RS code so it
+ * survives with very high probability -- e.g. a 16-byte header becomes
+ * RS(24,72), matching Picocrypt's header treatment. */
+const fec_hdr_length_trailer int = 8
+
+/* The bulk ciphertext is chunked into 128-byte blocks, each RS(128,136)
+ * encoded a byte at a time (one shard == one byte). */
+const fec_body_data_shards   int = 128
+const fec_body_parity_shards int = 8
+
+/* fec_rs_encode treats in as data_shards single-byte shards, appends
+ * parity_shards single-byte parity shards, and returns the flattened
+ * data+parity bytes (len(in) == data_shards). */
+func fec_rs_encode(in []byte, data_shards int, parity_shards int) ([]byte, int) {
+    enc, err := reedsolomon.New(data_shards, parity_shards)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    shards := make([][]byte, data_shards + parity_shards)
+    for i := 0; i < data_shards; i++ {
+        shards[i] = []byte{in[i]}
+    }
+    for i := data_shards; i < data_shards + parity_shards; i++ {
+        shards[i] = make([]byte, 1)
+    }
+
+    if err := enc.Encode(shards); err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    out := make([]byte, 0, data_shards + parity_shards)
+    for _, sh := range shards {
+        out = append(out, sh[0])
+    }
+
+    return out, STATUS_OK
+}
+
+/* fec_rs_decode is the inverse of fec_rs_encode. When fast is true, it skips
+ * verification and trusts the first data_shards bytes (FLAG_FEC_FAST). When
+ * fast is false, it verifies parity and, on mismatch, tries erasing each
+ * shard position in turn until one reconstructs cleanly. */
+func fec_rs_decode(in []byte, data_shards int, parity_shards int, fast bool) ([]byte, int) {
+    if fast {
+        return in[:data_shards], STATUS_OK
+    }
+
+    enc, err := reedsolomon.New(data_shards, parity_shards)
+    if err != nil {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    shards := make([][]byte, data_shards + parity_shards)
+    for i := range shards {
+        shards[i] = []byte{in[i]}
+    }
+
+    if ok, _ := enc.Verify(shards); ok {
+        out := make([]byte, data_shards)
+        for i := 0; i < data_shards; i++ {
+            out[i] = shards[i][0]
+        }
+        return out, STATUS_OK
+    }
+
+    /* Parity failed: brute-force a single erasure across all shard positions */
+    for erased := range shards {
+        attempt := make([][]byte, len(shards))
+        for i, sh := range shards {
+            if i == erased {
+                attempt[i] = nil
+                continue
+            }
+            attempt[i] = []byte{sh[0]}
+        }
+
+        if err := enc.Reconstruct(attempt); err != nil {
+            continue
+        }
+
+        if ok, _ := enc.Verify(attempt); ok {
+            out := make([]byte, data_shards)
+            for i := 0; i < data_shards; i++ {
+                out[i] = attempt[i][0]
+            }
+            return out, STATUS_OK
+        }
+    }
+
+    return nil, STATUS_FEC_UNRECOVERABLE
+}
+
+/* fec_encode_container wraps a blob whose first hdr_len bytes are the
+ * container's critical header (version/salt/nonce/hmac, or in the pre-AEAD
+ * format just the IV): that header plus an 8-byte length trailer goes
+ * through the heavy 2x RS code, and the remainder is chunked into 128-byte
+ * blocks each RS(128,136) encoded. */
+func fec_encode_container(blob []byte, hdr_len int) ([]byte, int) {
+    if len(blob) < hdr_len {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    hdr := blob[:hdr_len]
+    body := blob[hdr_len:]
+
+    hdr_data_shards := hdr_len + fec_hdr_length_trailer
+    hdr_parity_shards := hdr_data_shards * 2
+
+    payload := make([]byte, hdr_data_shards)
+    copy(payload, hdr)
+    binary.BigEndian.PutUint64(payload[hdr_len:hdr_data_shards], uint64(len(body)))
+
+    encoded_hdr, status := fec_rs_encode(payload, hdr_data_shards, hdr_parity_shards)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    var out bytes.Buffer
+    out.Write(encoded_hdr)
+
+    for off := 0; off < len(body); off += fec_body_data_shards {
+        block := make([]byte, fec_body_data_shards)
+        copy(block, body[off:])
+
+        encoded_block, status := fec_rs_encode(block, fec_body_data_shards, fec_body_parity_shards)
+        if status != STATUS_OK {
+            return nil, status
+        }
+
+        out.Write(encoded_block)
+    }
+
+    return out.Bytes(), STATUS_OK
+}
+
+/* fec_decode_container is the inverse of fec_encode_container. */
+func fec_decode_container(raw []byte, hdr_len int, fast bool) ([]byte, int) {
+    hdr_data_shards := hdr_len + fec_hdr_length_trailer
+    hdr_parity_shards := hdr_data_shards * 2
+    hdr_share_len := hdr_data_shards + hdr_parity_shards
+    if len(raw) < hdr_share_len {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    hdr, status := fec_rs_decode(raw[:hdr_share_len], hdr_data_shards, hdr_parity_shards, fast)
+    if status != STATUS_OK {
+        return nil, status
+    }
+
+    header := hdr[:hdr_len]
+    body_len := binary.BigEndian.Uint64(hdr[hdr_len:hdr_data_shards])
+
+    body_share_len := fec_body_data_shards + fec_body_parity_shards
+    remaining := raw[hdr_share_len:]
+
+    var body bytes.Buffer
+    for off := 0; off+body_share_len <= len(remaining); off += body_share_len {
+        block, status := fec_rs_decode(remaining[off:off+body_share_len], fec_body_data_shards, fec_body_parity_shards, fast)
+        if status != STATUS_OK {
+            return nil, status
+        }
+        body.Write(block)
+    }
+
+    if uint64(body.Len()) < body_len {
+        return nil, STATUS_FS_ENC_COMP
+    }
+
+    out := make([]byte, 0, hdr_len + int(body_len))
+    out = append(out, header...)
+    out = append(out, body.Bytes()[:body_len]...)
+    return out, STATUS_OK
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+import (
+    "bytes"
+    "math/rand"
+    "testing"
+)
+
+/* flip_random_byte corrupts one byte of buf (picked by r) and returns the
+ * index it touched, so a failing test can report where. */
+func flip_random_byte(r *rand.Rand, buf []byte) int {
+    i := r.Intn(len(buf))
+    buf[i] ^= 0xff
+    return i
+}
+
+func TestFecRsEncodeDecodeRecoversSingleByteCorruption(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+
+    in := make([]byte, fec_body_data_shards)
+    r.Read(in)
+
+    encoded, status := fec_rs_encode(in, fec_body_data_shards, fec_body_parity_shards)
+    if status != STATUS_OK {
+        t.Fatalf("fec_rs_encode failed: %d", status)
+    }
+
+    for trial := 0; trial < 16; trial++ {
+        corrupted := append([]byte(nil), encoded...)
+        idx := flip_random_byte(r, corrupted)
+
+        out, status := fec_rs_decode(corrupted, fec_body_data_shards, fec_body_parity_shards, false)
+        if status != STATUS_OK {
+            t.Fatalf("trial %d: fec_rs_decode failed to recover byte %d corruption: %d", trial, idx, status)
+        }
+        if !bytes.Equal(out, in) {
+            t.Fatalf("trial %d: recovered data does not match original after corrupting byte %d", trial, idx)
+        }
+    }
+}
+
+func TestFecEncodeDecodeContainerRecoversCorruption(t *testing.T) {
+    r := rand.New(rand.NewSource(2))
+
+    const hdr_len = fs_container_hdr_size
+    blob := make([]byte, hdr_len+500)
+    r.Read(blob)
+
+    encoded, status := fec_encode_container(blob, hdr_len)
+    if status != STATUS_OK {
+        t.Fatalf("fec_encode_container failed: %d", status)
+    }
+
+    for trial := 0; trial < 16; trial++ {
+        corrupted := append([]byte(nil), encoded...)
+        idx := flip_random_byte(r, corrupted)
+
+        out, status := fec_decode_container(corrupted, hdr_len, false)
+        if status != STATUS_OK {
+            t.Fatalf("trial %d: fec_decode_container failed to recover byte %d corruption: %d", trial, idx, status)
+        }
+        if !bytes.Equal(out, blob) {
+            t.Fatalf("trial %d: recovered container does not match original after corrupting byte %d", trial, idx)
+        }
+    }
+}
+
+func TestFecEncodeDecodeContainerFastPathTrustsInput(t *testing.T) {
+    const hdr_len = fs_container_hdr_size
+    blob := make([]byte, hdr_len+200)
+    rand.New(rand.NewSource(3)).Read(blob)
+
+    encoded, status := fec_encode_container(blob, hdr_len)
+    if status != STATUS_OK {
+        t.Fatalf("fec_encode_container failed: %d", status)
+    }
+
+    out, status := fec_decode_container(encoded, hdr_len, true)
+    if status != STATUS_OK {
+        t.Fatalf("fec_decode_container (fast) failed on uncorrupted input: %d", status)
+    }
+    if !bytes.Equal(out, blob) {
+        t.Fatalf("fast-path recovered container does not match original")
+    }
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package gofs
+
+/* govfs_names.go -- FLAG_ENCRYPT_NAMES support, modeled on gocryptfs's
+ * filename encryption: every path segment is EME-enciphered independently,
+ * tweaked by its parent directory's DirIV, so renaming a leaf never needs
+ * to touch any other entry and two identically-named files in different
+ * directories never produce the same ciphertext. An entry whose whole
+ * encoded chain is longer than name_longname_threshold bytes is indirected
+ * through a gocryptfs.longname.<sha256> marker, with the real chain stored
+ * alongside the entry's data in the stream.
+ */
+
+import (
+    "crypto/aes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "io"
+    "strings"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/hkdf"
+
+    "github.com/rfjakob/eme"
+)
+
+const name_longname_prefix string = "gocryptfs.longname."
+const name_longname_threshold int = 200 /* encoded chains longer than this get indirected */
+const name_check_plaintext string = "govfs-name-check"
+
+/* derive_name_key stretches passphrase+salt into its own 128-bit EME key,
+ * via the same Argon2id master key as derive_keys but a distinct HKDF info
+ * string, so the name key can be reasoned about independently of the
+ * content encryption/MAC subkeys. */
+func derive_name_key(passphrase string, salt []byte, params KDFParams) []byte {
+    master := argon2.IDKey([]byte(passphrase), salt, params.Passes, params.MemoryKiB, params.Parallelism, 32)
+
+    name_key := make([]byte, 16)
+    io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("govfs-name-key")), name_key)
+    return name_key
+}
+
+func new_eme_cipher(name_key []byte) *eme.EMECipher {
+    block, err := aes.NewCipher(name_key)
+    if err != nil {
+        return nil
+    }
+    return eme.New(block)
+}
+
+/* random_dir_iv generates a fresh per-directory EME tweak. */
+func random_dir_iv() [16]byte {
+    var iv [16]byte
+    io.ReadFull(rand.Reader, iv[:])
+    return iv
+}
+
+func pkcs7_pad(data []byte, block_size int) []byte {
+    pad := block_size - len(data)%block_size
+    padded := make([]byte, len(data)+pad)
+    copy(padded, data)
+    for i := len(data); i < len(padded); i++ {
+        padded[i] = byte(pad)
+    }
+    return padded
+}
+
+func pkcs7_unpad(data []byte) ([]byte, bool) {
+    if len(data) == 0 || len(data)%16 != 0 {
+        return nil, false
+    }
+
+    pad := int(data[len(data)-1])
+    if pad <= 0 || pad > 16 || pad > len(data) {
+        return nil, false
+    }
+
+    for _, b := range data[len(data)-pad:] {
+        if int(b) != pad {
+            return nil, false
+        }
+    }
+
+    return data[:len(data)-pad], true
+}
+
+/* encrypt_name_segment EME-encrypts a single path segment (never a full
+ * path) under name_key, tweaked by its parent directory's DirIV, and
+ * base64url-encodes the result so it is safe to use as an on-disk name. */
+func encrypt_name_segment(plain string, name_key []byte, dir_iv [16]byte) string {
+    cipher := new_eme_cipher(name_key)
+    ct := cipher.Encrypt(dir_iv[:], pkcs7_pad([]byte(plain), 16))
+    return base64.RawURLEncoding.EncodeToString(ct)
+}
+
+func decrypt_name_segment(encoded string, name_key []byte, dir_iv [16]byte) (string, bool) {
+    ct, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil || len(ct) == 0 || len(ct)%16 != 0 {
+        return "", false
+    }
+
+    cipher := new_eme_cipher(name_key)
+    plain, ok := pkcs7_unpad(cipher.Decrypt(dir_iv[:], ct))
+    if !ok {
+        return "", false
+    }
+
+    return string(plain), true
+}
+
+/* encrypt_path_chain encrypts every "/"-separated segment of path
+ * independently and returns them re-joined in the same shape, e.g.
+ * "/a/b" -> "/xx/yy". dir_iv_of resolves the DirIV of a plaintext ancestor
+ * directory (root_dir_iv is used for top-level segments). */
+func encrypt_path_chain(path string, name_key []byte, root_dir_iv [16]byte, dir_iv_of func(ancestor string) [16]byte) string {
+    path = strings.TrimSuffix(path, "/")
+    if path == "" {
+        return "/"
+    }
+
+    segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+    var out strings.Builder
+    ancestor := ""
+    for _, seg := range segments {
+        iv := root_dir_iv
+        if ancestor != "" {
+            iv = dir_iv_of(ancestor)
+        }
+
+        out.WriteString("/")
+        out.WriteString(encrypt_name_segment(seg, name_key, iv))
+        ancestor += "/" + seg
+    }
+
+    return out.String()
+}
+
+/* resolve_encrypted_path decrypts chain (a "/"-joined sequence of EME
+ * ciphertext segments produced by encrypt_path_chain) back into its
+ * plaintext path. dir_ivs maps a directory's own still-encrypted chain to
+ * its DirIV, so every entry resolves independently of stream read order --
+ * see mount_db. */
+func resolve_encrypted_path(chain string, name_key []byte, dir_ivs map[string][16]byte) (string, bool) {
+    if chain == "/" || chain == "" {
+        return "/", true
+    }
+
+    segments := strings.Split(strings.TrimPrefix(chain, "/"), "/")
+
+    ancestor_chain := ""
+    var plain strings.Builder
+    for _, seg := range segments {
+        iv, ok := dir_ivs[ancestor_chain]
+        if !ok {
+            return "", false
+        }
+
+        plain_seg, ok := decrypt_name_segment(seg, name_key, iv)
+        if !ok {
+            return "", false
+        }
+
+        plain.WriteString("/")
+        plain.WriteString(plain_seg)
+        ancestor_chain += "/" + seg
+    }
+
+    return plain.String(), true
+}
+
+/* longname_marker returns the gocryptfs.longname.<sha256> stand-in name
+ * used in place of chain whenever it would overflow RawFile.Name -- the
+ * hash is of the whole chain, since that (not just the leaf) is what gets
+ * stored alongside the entry. */
+func longname_marker(chain string) string {
+    sum := sha256.Sum256([]byte(chain))
+    return name_longname_prefix + hex.EncodeToString(sum[:])
+}
+
+/* name_check is the value gofs compares at mount time to catch a wrong
+ * passphrase deriving a wrong name_key -- EME has no MAC of its own, so
+ * without this a bad key would surface as garbled filenames instead of a
+ * clean STATUS_AUTH_FAIL. */
+func name_check(name_key []byte, root_dir_iv [16]byte) [32]byte {
+    ct := encrypt_name_segment(name_check_plaintext, name_key, root_dir_iv)
+    return sha256.Sum256([]byte(ct))
+}